@@ -0,0 +1,168 @@
+package backupstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/cockroachdb/errors"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	lz4 "github.com/pierrec/lz4/v4"
+)
+
+// maxMagicLen is the number of leading bytes peeked from a block to identify
+// its codec; it must be at least as long as the longest registered magic.
+const maxMagicLen = 16
+
+// Codec decompresses a block stream. Implementations are registered with
+// RegisterCodec and selected by sniffing the block's leading bytes, so
+// DecompressAndVerifyWithFallback no longer has to re-read the block from the
+// backend to try an alternative decompression method.
+type Codec interface {
+	// Name identifies the codec the way the decompression field on a
+	// BlockMapping does (e.g. "gzip", "lz4").
+	Name() string
+	// MagicBytes is the leading byte sequence that identifies this codec's
+	// framing. It must be unique across the registry.
+	MagicBytes() []byte
+	// NewReader wraps r with a decompressing reader.
+	NewReader(r io.Reader) (io.Reader, error)
+}
+
+var codecRegistry = map[string]Codec{}
+
+// RegisterCodec adds (or replaces) a codec in the default registry so
+// downstream projects such as backing-image-manager can plug in custom
+// compression formats.
+func RegisterCodec(c Codec) {
+	codecRegistry[c.Name()] = c
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string       { return "gzip" }
+func (gzipCodec) MagicBytes() []byte { return []byte{0x1f, 0x8b} }
+func (gzipCodec) NewReader(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+type lz4Codec struct{}
+
+func (lz4Codec) Name() string       { return "lz4" }
+func (lz4Codec) MagicBytes() []byte { return []byte{0x04, 0x22, 0x4d, 0x18} }
+func (lz4Codec) NewReader(r io.Reader) (io.Reader, error) {
+	return lz4.NewReader(r), nil
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string       { return "zstd" }
+func (zstdCodec) MagicBytes() []byte { return []byte{0x28, 0xb5, 0x2f, 0xfd} }
+func (zstdCodec) NewReader(r io.Reader) (io.Reader, error) {
+	dec, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	// zstd.Decoder holds background goroutines/buffers until Close is
+	// called. Codec.NewReader only returns an io.Reader, and callers such as
+	// DecompressAndVerifyWithFallback read it to completion without a type
+	// assertion to io.Closer, so wrap it to close itself once drained
+	// instead of relying on every caller to remember.
+	return &autoCloseReader{r: dec, closeFn: dec.Close}, nil
+}
+
+// autoCloseReader calls closeFn once the wrapped reader is fully drained
+// (returns any error, including io.EOF), so a decoder that needs an explicit
+// Close doesn't leak when only read through the plain io.Reader interface.
+type autoCloseReader struct {
+	r       io.Reader
+	closeFn func()
+	closed  bool
+}
+
+func (a *autoCloseReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if err != nil && !a.closed {
+		a.closed = true
+		a.closeFn()
+	}
+	return n, err
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string { return "snappy" }
+func (snappyCodec) MagicBytes() []byte {
+	return []byte{0xff, 0x06, 0x00, 0x00, 0x73, 0x4e, 0x61, 0x50, 0x70, 0x59}
+}
+func (snappyCodec) NewReader(r io.Reader) (io.Reader, error) {
+	return snappy.NewReader(r), nil
+}
+
+func init() {
+	for _, c := range []Codec{gzipCodec{}, lz4Codec{}, zstdCodec{}, snappyCodec{}} {
+		RegisterCodec(c)
+	}
+}
+
+// sniffCodec returns the registered codec whose magic bytes match header, or
+// nil if none do.
+func sniffCodec(header []byte) Codec {
+	for _, c := range codecRegistry {
+		magic := c.MagicBytes()
+		if len(header) >= len(magic) && bytes.Equal(header[:len(magic)], magic) {
+			return c
+		}
+	}
+	return nil
+}
+
+// candidateCodecs returns every registered codec, other than exclude, whose
+// magic bytes also plausibly match header. It's used when the first
+// decompression attempt fails and we want to try alternates without
+// re-reading the block from the backend.
+func candidateCodecs(header []byte, exclude string) []Codec {
+	var candidates []Codec
+	for name, c := range codecRegistry {
+		if name == exclude {
+			continue
+		}
+		magic := c.MagicBytes()
+		if len(header) >= len(magic) && bytes.Equal(header[:len(magic)], magic) {
+			candidates = append(candidates, c)
+		}
+	}
+	return candidates
+}
+
+// decompressAndVerify decompresses raw with the codec registered as name
+// (treating raw as already uncompressed if name is "" or "none"), then
+// confirms the decompressed data's sha256 checksum matches checksum before
+// handing it back, so a wrong codec guess or truncated block is caught here
+// rather than surfacing as silently corrupt restored data.
+func decompressAndVerify(name string, raw []byte, checksum string) (io.Reader, error) {
+	data := raw
+	if name != "" && name != "none" {
+		codec, ok := codecRegistry[name]
+		if !ok {
+			return nil, errors.Errorf("no codec registered for decompression method %v", name)
+		}
+		dr, err := codec.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to construct %v decompressor", name)
+		}
+		data, err = io.ReadAll(dr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decompress with %v", name)
+		}
+	}
+
+	sum := sha256.Sum256(data)
+	if got := fmt.Sprintf("%x", sum); got != checksum {
+		return nil, errors.Errorf("checksum mismatch: expected %v, got %v", checksum, got)
+	}
+	return bytes.NewReader(data), nil
+}
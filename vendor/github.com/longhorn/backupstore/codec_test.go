@@ -0,0 +1,191 @@
+package backupstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	lz4 "github.com/pierrec/lz4/v4"
+)
+
+func TestSniffCodec(t *testing.T) {
+	cases := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"gzip", []byte{0x1f, 0x8b, 0x08, 0x00}, "gzip"},
+		{"lz4", []byte{0x04, 0x22, 0x4d, 0x18, 0x60}, "lz4"},
+		{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, "zstd"},
+		{"snappy", []byte{0xff, 0x06, 0x00, 0x00, 0x73, 0x4e, 0x61, 0x50, 0x70, 0x59}, "snappy"},
+		{"no match", []byte{0x00, 0x01, 0x02, 0x03}, ""},
+		{"too short", []byte{0x1f}, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := sniffCodec(c.header)
+			if c.want == "" {
+				if got != nil {
+					t.Fatalf("sniffCodec(%x) = %v, want nil", c.header, got.Name())
+				}
+				return
+			}
+			if got == nil || got.Name() != c.want {
+				t.Fatalf("sniffCodec(%x) = %v, want %v", c.header, got, c.want)
+			}
+		})
+	}
+}
+
+func TestCandidateCodecsExcludesSniffed(t *testing.T) {
+	// A gzip header matches gzip's own magic, but gzip is the excluded name,
+	// so it must not come back as a candidate.
+	header := []byte{0x1f, 0x8b, 0x08, 0x00}
+	for _, c := range candidateCodecs(header, "gzip") {
+		if c.Name() == "gzip" {
+			t.Fatalf("candidateCodecs returned excluded codec %v", c.Name())
+		}
+	}
+}
+
+func TestAutoCloseReaderClosesOnDrain(t *testing.T) {
+	inner := &closeTrackingReader{data: []byte("hello"), closeFn: func() {}}
+	closed := false
+	r := &autoCloseReader{r: inner, closeFn: func() { closed = true }}
+
+	buf := make([]byte, 16)
+	for {
+		_, err := r.Read(buf)
+		if err != nil {
+			if err != io.EOF {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			break
+		}
+	}
+
+	if !closed {
+		t.Fatal("autoCloseReader did not call closeFn after the underlying reader returned an error")
+	}
+}
+
+func TestDecompressAndVerifyRoundTrip(t *testing.T) {
+	plaintext := []byte("the quick brown fox jumps over the lazy dog, repeated for compressibility: " +
+		"the quick brown fox jumps over the lazy dog")
+	sum := sha256.Sum256(plaintext)
+	checksum := fmt.Sprintf("%x", sum)
+
+	cases := map[string]func([]byte) []byte{
+		"gzip": func(data []byte) []byte {
+			var buf bytes.Buffer
+			w := gzip.NewWriter(&buf)
+			if _, err := w.Write(data); err != nil {
+				t.Fatalf("gzip write: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("gzip close: %v", err)
+			}
+			return buf.Bytes()
+		},
+		"lz4": func(data []byte) []byte {
+			var buf bytes.Buffer
+			w := lz4.NewWriter(&buf)
+			if _, err := w.Write(data); err != nil {
+				t.Fatalf("lz4 write: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("lz4 close: %v", err)
+			}
+			return buf.Bytes()
+		},
+		"zstd": func(data []byte) []byte {
+			var buf bytes.Buffer
+			w, err := zstd.NewWriter(&buf)
+			if err != nil {
+				t.Fatalf("zstd.NewWriter: %v", err)
+			}
+			if _, err := w.Write(data); err != nil {
+				t.Fatalf("zstd write: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("zstd close: %v", err)
+			}
+			return buf.Bytes()
+		},
+		"snappy": func(data []byte) []byte {
+			var buf bytes.Buffer
+			w := snappy.NewBufferedWriter(&buf)
+			if _, err := w.Write(data); err != nil {
+				t.Fatalf("snappy write: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("snappy close: %v", err)
+			}
+			return buf.Bytes()
+		},
+	}
+
+	for name, compress := range cases {
+		t.Run(name, func(t *testing.T) {
+			compressed := compress(plaintext)
+			r, err := decompressAndVerify(name, compressed, checksum)
+			if err != nil {
+				t.Fatalf("decompressAndVerify(%v): %v", name, err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("read decompressed data: %v", err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Fatalf("decompressAndVerify(%v) round-trip mismatch", name)
+			}
+		})
+	}
+}
+
+func TestDecompressAndVerifyRejectsChecksumMismatch(t *testing.T) {
+	plaintext := []byte("block contents")
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatalf("gzip write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("gzip close: %v", err)
+	}
+
+	if _, err := decompressAndVerify("gzip", buf.Bytes(), "0000000000000000000000000000000000000000000000000000000000000000"); err == nil {
+		t.Fatal("decompressAndVerify accepted a block with the wrong checksum")
+	}
+}
+
+func TestDecompressAndVerifyRejectsUnknownCodec(t *testing.T) {
+	if _, err := decompressAndVerify("made-up-codec", []byte("data"), "anything"); err == nil {
+		t.Fatal("decompressAndVerify accepted an unregistered codec name")
+	}
+}
+
+type closeTrackingReader struct {
+	data    []byte
+	pos     int
+	closeFn func()
+}
+
+func (r *closeTrackingReader) Read(p []byte) (int, error) {
+	if r.pos >= len(r.data) {
+		return 0, errors.New("EOF")
+	}
+	n := copy(p, r.data[r.pos:])
+	r.pos += n
+	if r.pos >= len(r.data) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,32 @@
+package backupstore
+
+import (
+	"context"
+	"os"
+
+	"github.com/cockroachdb/errors"
+)
+
+// RestoreDeltaBlockBackup restores every block of a delta backup into
+// volDevPath, replacing the old serial read loop with RestoreBlocksParallel
+// so a remote backup store (S3/NFS) no longer serializes restore time behind
+// per-block round trips. volDevPath is opened for random-access writes
+// because the default (non-ordered) path writes blocks out of order via
+// FileSink.WriteAt.
+//
+// Note: backupbackingimage.restoreBlockToFile lives in a package that isn't
+// part of this vendored snapshot, so it could not be located and migrated
+// from here; only the volume restore path above is covered by this change.
+func RestoreDeltaBlockBackup(ctx context.Context, bsDriver BackupStoreDriver, volumeName, decompression, volDevPath string, blocks []BlockMapping) error {
+	f, err := os.OpenFile(volDevPath, os.O_WRONLY, 0)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %v for restore", volDevPath)
+	}
+	defer f.Close()
+
+	opts := RestoreOptions{
+		VolumeName:    volumeName,
+		Decompression: decompression,
+	}
+	return RestoreBlocksParallel(ctx, bsDriver, blocks, NewFileSink(f), opts)
+}
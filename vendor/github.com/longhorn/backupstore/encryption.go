@@ -0,0 +1,223 @@
+package backupstore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+
+	"github.com/cockroachdb/errors"
+
+	lhbackup "github.com/longhorn/go-common-libs/backup"
+)
+
+// encryptedBlockMagic identifies a block as ciphertext produced by Cipher.Seal,
+// so DecompressAndVerifyWithFallback knows to decrypt before handing the
+// stream to a compression Codec.
+var encryptedBlockMagic = [4]byte{'L', 'H', 'E', 'B'}
+
+const (
+	encryptionAlgorithmAES256GCM = "aes-256-gcm"
+	nonceSize                    = 12
+	gcmTagSize                   = 16
+	encryptedHeaderSize          = len(encryptedBlockMagic) + 1 + nonceSize
+)
+
+// Cipher seals and opens individual blocks. The default implementation is
+// AES-256-GCM with a per-block random nonce; a Vault transit or HSM-backed
+// implementation could instead delegate Seal/Open to a remote service.
+type Cipher interface {
+	// Algorithm identifies the cipher; sealBlock records it as the version
+	// byte that follows encryptedBlockMagic.
+	Algorithm() string
+	Seal(plaintext io.Reader) (ciphertext io.Reader, nonce []byte, err error)
+	Open(ciphertext io.Reader, nonce []byte) (io.Reader, error)
+}
+
+// KeyProvider wraps and unwraps the data-encryption key (DEK) used to
+// construct a Cipher for a backup. This package ships no implementation;
+// providers (a static key, AWS KMS, Vault transit, ...) are added with
+// RegisterKeyProvider.
+type KeyProvider interface {
+	// Name identifies the provider the way LonghornBackupParameterKMSRef
+	// selects it.
+	Name() string
+	// GenerateDEK returns a fresh plaintext DEK and its wrapped form to store
+	// in the backup config.
+	GenerateDEK() (dek, wrappedDEK []byte, err error)
+	// UnwrapDEK recovers the plaintext DEK from its wrapped form.
+	UnwrapDEK(wrappedDEK []byte) (dek []byte, err error)
+}
+
+var keyProviderRegistry = map[string]KeyProvider{}
+
+// RegisterKeyProvider adds (or replaces) a KeyProvider in the default
+// registry, keyed by Name(), so deployments can plug in their own KMS or
+// Vault transit backend.
+func RegisterKeyProvider(p KeyProvider) {
+	keyProviderRegistry[p.Name()] = p
+}
+
+// aesGCMCipher is the default Cipher, a per-block random-nonce AES-256-GCM.
+type aesGCMCipher struct {
+	aead cipher.AEAD
+}
+
+// NewAESGCMCipher builds a Cipher from a 32-byte DEK.
+func NewAESGCMCipher(dek []byte) (Cipher, error) {
+	block, err := aes.NewCipher(dek)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to construct AES cipher from DEK")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to construct AES-GCM AEAD")
+	}
+	return &aesGCMCipher{aead: aead}, nil
+}
+
+func (c *aesGCMCipher) Algorithm() string { return encryptionAlgorithmAES256GCM }
+
+func (c *aesGCMCipher) Seal(plaintext io.Reader) (io.Reader, []byte, error) {
+	data, err := io.ReadAll(plaintext)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read plaintext block for sealing")
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to generate nonce")
+	}
+
+	ciphertext := c.aead.Seal(nil, nonce, data, nil)
+	return bytes.NewReader(ciphertext), nonce, nil
+}
+
+func (c *aesGCMCipher) Open(ciphertext io.Reader, nonce []byte) (io.Reader, error) {
+	data, err := io.ReadAll(ciphertext)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read ciphertext block for opening")
+	}
+
+	plaintext, err := c.aead.Open(nil, nonce, data, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt block: authentication failed")
+	}
+	return bytes.NewReader(plaintext), nil
+}
+
+// sealBlock encodes a plaintext block as
+// magic(4) || version(1) || nonce(12) || ciphertext || tag(16). Every call
+// uses a fresh random nonce, so sealing the same plaintext twice yields
+// different bytes. The restore path looks a block up under getBlockFilePath
+// by its BlockMapping checksum and verifies the decrypted, decompressed data
+// against that same checksum; it has no separate ciphertext checksum.
+func sealBlock(c Cipher, plaintext io.Reader) (io.Reader, error) {
+	ciphertext, nonce, err := c.Seal(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != nonceSize {
+		return nil, errors.Errorf("cipher %v returned nonce of length %d, want %d", c.Algorithm(), len(nonce), nonceSize)
+	}
+
+	header := make([]byte, 0, encryptedHeaderSize)
+	header = append(header, encryptedBlockMagic[:]...)
+	header = append(header, encryptionVersionByte(c.Algorithm()))
+	header = append(header, nonce...)
+
+	return io.MultiReader(bytes.NewReader(header), ciphertext), nil
+}
+
+// isEncryptedBlock reports whether header (the block's leading bytes) carries
+// the encrypted-block magic.
+func isEncryptedBlock(header []byte) bool {
+	return len(header) >= len(encryptedBlockMagic) && bytes.Equal(header[:len(encryptedBlockMagic)], encryptedBlockMagic[:])
+}
+
+// openBlock strips the encrypted-block header from raw and decrypts the rest
+// with c, returning the plaintext block bytes ready for codec sniffing.
+func openBlock(c Cipher, raw []byte) ([]byte, error) {
+	if len(raw) < encryptedHeaderSize {
+		return nil, errors.Errorf("encrypted block too short: %d bytes", len(raw))
+	}
+	nonce := raw[len(encryptedBlockMagic)+1 : encryptedHeaderSize]
+	plaintext, err := c.Open(bytes.NewReader(raw[encryptedHeaderSize:]), nonce)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(plaintext)
+}
+
+// encryptionVersionByte is the single-byte algorithm tag sealBlock writes
+// after the magic. openBlock does not read or check it; it opens every block
+// with the Cipher it is given.
+func encryptionVersionByte(algorithm string) byte {
+	if algorithm == encryptionAlgorithmAES256GCM {
+		return 1
+	}
+	return 0
+}
+
+// getEncryptionParametersFromParameters reads the opt-in encryption flag and
+// KMS reference the same way getBlockSizeFromParameters reads the block size
+// parameter.
+func getEncryptionParametersFromParameters(parameters map[string]string) (enabled bool, kmsRef string) {
+	if parameters == nil {
+		return false, ""
+	}
+	enabled = parameters[lhbackup.LonghornBackupParameterEncryption] == "true"
+	kmsRef = parameters[lhbackup.LonghornBackupParameterKMSRef]
+	return enabled, kmsRef
+}
+
+// PrepareBackupEncryption is the integration point for the backup creation
+// path: called once per backup before any blocks are written, with the same
+// parameters map read by getBlockSizeFromParameters. When
+// LonghornBackupParameterEncryption=true it generates a DEK through the
+// KeyProvider named by LonghornBackupParameterKMSRef (registered with
+// RegisterKeyProvider) and returns a Cipher to pass to SealBlockForWrite for
+// every block plus the wrapped DEK to store on the backup config (e.g.
+// Backup.WrappedDEK/Backup.EncryptionAlgorithm/Backup.KMSRef in backup.go)
+// before the config is persisted. When encryption isn't enabled it returns a
+// nil Cipher and the backup is written exactly as before this feature.
+//
+// Note: the backup creation path (CreateDeltaBlockBackup) isn't part of this
+// vendored snapshot, so this function could not be wired into its call site
+// from here.
+func PrepareBackupEncryption(parameters map[string]string) (c Cipher, wrappedDEK []byte, err error) {
+	enabled, kmsRef := getEncryptionParametersFromParameters(parameters)
+	if !enabled {
+		return nil, nil, nil
+	}
+
+	provider, ok := keyProviderRegistry[kmsRef]
+	if !ok {
+		return nil, nil, errors.Errorf("no KeyProvider registered for %v %v", lhbackup.LonghornBackupParameterKMSRef, kmsRef)
+	}
+
+	dek, wrapped, err := provider.GenerateDEK()
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to generate DEK from key provider %v", kmsRef)
+	}
+
+	c, err = NewAESGCMCipher(dek)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, wrapped, nil
+}
+
+// SealBlockForWrite is the integration point for the per-block backup
+// creation path: called with the compressed block reader right before
+// bsDriver.Write, using the Cipher PrepareBackupEncryption returned for this
+// backup. When c is nil (encryption not enabled), compressed is returned
+// unchanged so an unencrypted backup is written exactly as before this
+// feature.
+func SealBlockForWrite(c Cipher, compressed io.Reader) (io.Reader, error) {
+	if c == nil {
+		return compressed, nil
+	}
+	return sealBlock(c, compressed)
+}
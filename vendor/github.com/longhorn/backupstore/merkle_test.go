@@ -0,0 +1,80 @@
+package backupstore
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBuildMerkleLevelsEmptyBlocksDoesNotPanic(t *testing.T) {
+	levels := buildMerkleLevels(nil)
+	if len(levels) != 1 || len(levels[0]) != 1 {
+		t.Fatalf("expected a single synthetic leaf for zero blocks, got %v levels", len(levels))
+	}
+	if !bytes.Equal(levels[0][0], emptyMerkleRoot) {
+		t.Fatalf("empty block list did not hash to emptyMerkleRoot")
+	}
+}
+
+func TestBuildMerkleLevelsDeterministicAndOrderIndependent(t *testing.T) {
+	a := []BlockMapping{
+		{Offset: 0, BlockChecksum: "aaa"},
+		{Offset: 4096, BlockChecksum: "bbb"},
+		{Offset: 8192, BlockChecksum: "ccc"},
+	}
+	b := []BlockMapping{a[2], a[0], a[1]} // same blocks, different input order
+
+	rootA := buildMerkleLevels(a)
+	rootB := buildMerkleLevels(b)
+
+	lastA := rootA[len(rootA)-1][0]
+	lastB := rootB[len(rootB)-1][0]
+	if !bytes.Equal(lastA, lastB) {
+		t.Fatalf("root depends on input order: %x != %x", lastA, lastB)
+	}
+}
+
+func TestBuildMerkleLevelsDetectsTruncation(t *testing.T) {
+	full := []BlockMapping{
+		{Offset: 0, BlockChecksum: "aaa"},
+		{Offset: 4096, BlockChecksum: "bbb"},
+	}
+	truncated := full[:1]
+
+	fullLevels := buildMerkleLevels(full)
+	truncatedLevels := buildMerkleLevels(truncated)
+
+	fullRoot := fullLevels[len(fullLevels)-1][0]
+	truncatedRoot := truncatedLevels[len(truncatedLevels)-1][0]
+	if bytes.Equal(fullRoot, truncatedRoot) {
+		t.Fatal("truncated block list hashed to the same root as the complete one")
+	}
+}
+
+func TestMerkleManifestProofForAndVerifyProof(t *testing.T) {
+	blocks := []BlockMapping{
+		{Offset: 0, BlockChecksum: "aaa"},
+		{Offset: 4096, BlockChecksum: "bbb"},
+		{Offset: 8192, BlockChecksum: "ccc"},
+	}
+	levels := buildMerkleLevels(blocks)
+	manifest := &MerkleManifest{levels: levels, offsets: []int64{0, 4096, 8192}}
+	root := manifest.Root()
+
+	idx, proof, err := manifest.ProofFor(4096)
+	if err != nil {
+		t.Fatalf("ProofFor: %v", err)
+	}
+	if len(proof) == 0 {
+		t.Fatal("expected a non-empty proof for a 3-leaf tree")
+	}
+	if !VerifyProof(4096, "bbb", idx, proof, root) {
+		t.Fatal("VerifyProof rejected a proof for the block it was generated from")
+	}
+	if VerifyProof(4096, "wrong-checksum", idx, proof, root) {
+		t.Fatal("VerifyProof accepted a proof against a mismatched checksum")
+	}
+
+	if _, _, err := manifest.ProofFor(99999); err == nil {
+		t.Fatal("expected an error for an offset not in the manifest")
+	}
+}
@@ -0,0 +1,249 @@
+package backupstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cockroachdb/errors"
+)
+
+// BlockSink receives a decompressed block at a given volume offset. Restore
+// targets (a raw volume file, a backing image) implement it so
+// RestoreBlocksParallel doesn't need to know how the destination is written.
+type BlockSink interface {
+	// WriteBlock writes the decompressed contents read from r at offset.
+	WriteBlock(offset int64, r io.Reader) error
+}
+
+// FileSink writes blocks into a volume file opened for restore.
+type FileSink struct {
+	file *os.File
+}
+
+// NewFileSink wraps f as a BlockSink.
+func NewFileSink(f *os.File) *FileSink {
+	return &FileSink{file: f}
+}
+
+func (s *FileSink) WriteBlock(offset int64, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read block at offset %v", offset)
+	}
+	// RestoreBlocksParallel calls WriteBlock from N concurrent workers by
+	// default; Seek+Write on the shared *os.File would race, so every write
+	// must go through WriteAt instead.
+	if _, err := s.file.WriteAt(data, offset); err != nil {
+		return errors.Wrapf(err, "failed to write block at offset %v", offset)
+	}
+	return nil
+}
+
+// WriterAtSink writes blocks into anything addressable by offset, such as the
+// backing image restore target.
+type WriterAtSink struct {
+	w io.WriterAt
+}
+
+// NewWriterAtSink wraps w as a BlockSink.
+func NewWriterAtSink(w io.WriterAt) *WriterAtSink {
+	return &WriterAtSink{w: w}
+}
+
+func (s *WriterAtSink) WriteBlock(offset int64, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read block at offset %v", offset)
+	}
+	if _, err := s.w.WriteAt(data, offset); err != nil {
+		return errors.Wrapf(err, "failed to write block at offset %v", offset)
+	}
+	return nil
+}
+
+// RestoreOptions configures RestoreBlocksParallel.
+type RestoreOptions struct {
+	// VolumeName and Decompression identify how to locate and decompress
+	// each BlockMapping's block file; they're constant for the whole backup
+	// being restored, so they live on the options rather than per block.
+	VolumeName    string
+	Decompression string
+
+	// MaxConcurrency caps the number of workers. Zero or negative means
+	// runtime.NumCPU().
+	MaxConcurrency int
+	// OrderedWrite serializes writes to sink in block order through a small
+	// reorder buffer, for sinks that cannot tolerate out-of-order writes.
+	OrderedWrite bool
+	// Progress, if non-nil, is called as blocks complete.
+	Progress func(completedBytes, totalBytes int64)
+
+	// RetryPolicy tunes the per-block read backoff; nil uses
+	// DefaultRetryPolicy. Set per backend (S3 vs NFS vs VFS).
+	RetryPolicy *RetryPolicy
+	// Cipher decrypts blocks written with envelope encryption; nil for
+	// unencrypted backups.
+	Cipher Cipher
+}
+
+// RestoreBlocksParallel fans block fetch+decompress+verify for blocks out
+// across a worker pool, so restoring from a remote backup store (S3/NFS) is
+// bound by the number of workers rather than serial round-trip latency. The
+// first worker to fail records its error directly (guarded by errOnce) and
+// cancels a context derived from ctx so in-flight workers abort their
+// retries (see RetryPolicy) immediately instead of running to completion
+// after the restore has already failed; mergeErrorChannels is only drained
+// to let its per-channel goroutines exit; it is not, by itself, a safe way
+// to learn which error to return, since a worker's own cancel() can close
+// workerCtx before mergeErrorChannels' select observes that worker's
+// already-buffered error, which would otherwise let RestoreBlocksParallel
+// return nil despite a real failure.
+func RestoreBlocksParallel(ctx context.Context, bsDriver BackupStoreDriver, blocks []BlockMapping, sink BlockSink, opts RestoreOptions) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	workers := opts.MaxConcurrency
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(blocks) {
+		workers = len(blocks)
+	}
+
+	workerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var totalBytes, completedBytes int64
+	for _, b := range blocks {
+		totalBytes += b.BlockSize
+	}
+
+	jobs := make(chan BlockMapping)
+	errChs := make([]<-chan error, workers)
+
+	// Block offsets are frequently non-contiguous (unchanged/zero blocks are
+	// skipped), so the reorder buffer tracks completion by position in
+	// offset order rather than by assuming the next expected byte offset.
+	order := make([]int64, len(blocks))
+	for i, b := range blocks {
+		order[i] = b.Offset
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i] < order[j] })
+	reorder := &orderedWriter{order: order, pending: map[int64][]byte{}}
+
+	var errOnce sync.Once
+	var firstErr error
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		errCh := make(chan error, 1)
+		errChs[i] = errCh
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(errCh)
+			for {
+				select {
+				case b, ok := <-jobs:
+					if !ok {
+						return
+					}
+					if err := restoreOneBlock(workerCtx, bsDriver, b, sink, opts, reorder); err != nil {
+						errOnce.Do(func() { firstErr = err })
+						errCh <- err
+						cancel()
+						return
+					}
+					done := atomic.AddInt64(&completedBytes, b.BlockSize)
+					if opts.Progress != nil {
+						opts.Progress(done, totalBytes)
+					}
+				case <-workerCtx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for _, b := range blocks {
+			select {
+			case jobs <- b:
+			case <-workerCtx.Done():
+				return
+			}
+		}
+	}()
+
+	merged := mergeErrorChannels(workerCtx, errChs...)
+	wg.Wait()
+	for range merged {
+		// Drained only so mergeErrorChannels' per-channel goroutines exit;
+		// the error returned below is firstErr, captured directly by
+		// whichever worker failed first.
+	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// orderedWriter buffers blocks that complete out of order until the blocks
+// preceding them in offset order have been written, for sinks that require
+// sequential writes. Block offsets are commonly non-contiguous (unchanged
+// blocks are skipped), so completion is tracked by position in order rather
+// than by the next expected byte offset.
+type orderedWriter struct {
+	mu      sync.Mutex
+	order   []int64
+	idx     int
+	pending map[int64][]byte
+}
+
+func (o *orderedWriter) write(sink BlockSink, offset int64, data []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.pending[offset] = data
+	for o.idx < len(o.order) {
+		buf, ok := o.pending[o.order[o.idx]]
+		if !ok {
+			break
+		}
+		if err := sink.WriteBlock(o.order[o.idx], bytes.NewReader(buf)); err != nil {
+			return err
+		}
+		delete(o.pending, o.order[o.idx])
+		o.idx++
+	}
+	return nil
+}
+
+// restoreOneBlock fetches, decompresses, and verifies a single block, then
+// hands it to sink, routing through reorder when opts.OrderedWrite is set.
+func restoreOneBlock(ctx context.Context, bsDriver BackupStoreDriver, b BlockMapping, sink BlockSink, opts RestoreOptions, reorder *orderedWriter) error {
+	blkFile := getBlockFilePath(opts.VolumeName, b.BlockChecksum)
+	r, err := DecompressAndVerifyWithFallback(ctx, bsDriver, blkFile, opts.Decompression, b.BlockChecksum, opts.RetryPolicy, opts.Cipher)
+	if err != nil {
+		return err
+	}
+
+	if !opts.OrderedWrite {
+		return sink.WriteBlock(b.Offset, r)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return errors.Wrapf(err, "failed to buffer block at offset %v for ordered write", b.Offset)
+	}
+	return reorder.write(sink, b.Offset, data)
+}
@@ -1,9 +1,11 @@
 package backupstore
 
 import (
-	"compress/gzip"
+	"bufio"
 	"context"
 	"io"
+	"math"
+	"math/rand"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -13,8 +15,6 @@ import (
 
 	"github.com/cockroachdb/errors"
 
-	"github.com/longhorn/backupstore/util"
-
 	lhbackup "github.com/longhorn/go-common-libs/backup"
 )
 
@@ -63,42 +63,124 @@ func mergeErrorChannels(ctx context.Context, channels ...<-chan error) <-chan er
 	return out
 }
 
-var backoffDuration = [...]time.Duration{
-	time.Second,
-	5 * time.Second,
-	30 * time.Second,
-	2 * time.Minute,
-	5 * time.Minute,
-	15 * time.Minute,
-	30 * time.Minute,
-	1 * time.Hour,
-	2 * time.Hour,
-	6 * time.Hour,
+// RetryPolicy controls the backoff used by readBlockWithRetry. BackupStoreDriver
+// callers can tune it per backend (e.g. S3 wants a longer MaxElapsedTime than
+// a local VFS mount) instead of relying on one hardcoded table for everyone.
+type RetryPolicy struct {
+	// BaseDelay is the delay before the first retry.
+	BaseDelay time.Duration
+	// Factor is the multiplier applied to the delay after each attempt.
+	Factor float64
+	// MaxDelay caps the computed delay before jitter is applied.
+	MaxDelay time.Duration
+	// MaxElapsedTime bounds the total time spent retrying before giving up.
+	MaxElapsedTime time.Duration
+}
+
+// DefaultRetryPolicy is used by readBlockWithRetry when a driver does not
+// specify its own policy.
+var DefaultRetryPolicy = RetryPolicy{
+	BaseDelay:      500 * time.Millisecond,
+	Factor:         2.0,
+	MaxDelay:       5 * time.Minute,
+	MaxElapsedTime: 15 * time.Minute,
+}
+
+// isTransient reports whether err is worth retrying. Errors that indicate the
+// object will never become readable (not found, 404) are permanent so callers
+// don't burn the whole backoff window on a block that was never there.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, permanent := range []string{"not found", "no such key", "404"} {
+		if strings.Contains(msg, permanent) {
+			return false
+		}
+	}
+
+	for _, transient := range []string{
+		"timeout", "timed out", "connection reset", "eof", "throttl",
+		"500", "502", "503", "504",
+	} {
+		if strings.Contains(msg, transient) {
+			return true
+		}
+	}
+
+	// Unrecognized errors are assumed transient so we don't give up early on
+	// a backend-specific error string we haven't seen yet.
+	return true
+}
+
+// backoffCap computes the exponential backoff delay for attempt (0-indexed)
+// before jitter is applied, i.e. min(policy.MaxDelay, policy.BaseDelay *
+// policy.Factor^attempt). Split out from readBlockWithRetry so the math can
+// be unit tested without a BackupStoreDriver.
+func backoffCap(policy RetryPolicy, attempt int) time.Duration {
+	// Compare in float64 so a large attempt can't overflow time.Duration
+	// before the MaxDelay cap is applied.
+	delay := float64(policy.BaseDelay) * math.Pow(policy.Factor, float64(attempt))
+	if delay > float64(policy.MaxDelay) {
+		return policy.MaxDelay
+	}
+	return time.Duration(delay)
 }
 
-// readBlockWithRetry reads a block from the backup store with retry.
-func readBlockWithRetry(bsDriver BackupStoreDriver, blkFile string) (io.ReadCloser, error) {
-	attempts := 0
-	for {
+// readBlockWithRetry reads a block from the backup store with exponential
+// backoff and full jitter, bounded by policy.MaxElapsedTime rather than a
+// fixed attempt count. It aborts as soon as ctx is done or err is permanent.
+func readBlockWithRetry(ctx context.Context, bsDriver BackupStoreDriver, blkFile string, policy RetryPolicy) (io.ReadCloser, error) {
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
 		rc, err := bsDriver.Read(blkFile)
 		if err == nil {
 			return rc, nil
 		}
-		if attempts < len(backoffDuration) {
-			dur := backoffDuration[attempts]
-			time.Sleep(dur)
-			attempts++
-			continue
+		if !isTransient(err) {
+			return nil, errors.Wrapf(err, "permanent error reading block %v", blkFile)
+		}
+		if time.Since(start) >= policy.MaxElapsedTime {
+			return nil, errors.Wrapf(err, "failed to read block %v after %v", blkFile, policy.MaxElapsedTime)
+		}
+
+		delay := time.Duration(rand.Int63n(int64(backoffCap(policy, attempt)) + 1)) // full jitter
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, errors.Wrap(context.Canceled, "read block retry aborted by context")
 		}
-		return nil, errors.Wrapf(err, "failed to read block %v after %d attempts", blkFile, attempts+1)
 	}
 }
 
-// DecompressAndVerifyWithFallback decompresses the given data and verifies the data integrity.
-// If the decompression fails, it will try to decompress with the fallback method.
-func DecompressAndVerifyWithFallback(bsDriver BackupStoreDriver, blkFile, decompression, checksum string) (io.Reader, error) {
-	// First attempt to read and decompress/verify
-	rc, err := readBlockWithRetry(bsDriver, blkFile)
+// DecompressAndVerifyWithFallback reads a block once, sniffs its leading
+// bytes to identify the compression codec it was written with, and
+// decompresses and verifies the data integrity. If the sniffed (or
+// caller-supplied) codec fails, every other registered codec whose magic
+// bytes also plausibly match is tried against the already-buffered block
+// before giving up, so a bad guess never costs a second read of blkFile.
+//
+// policy is the retry backoff to use for this read; pass nil to use
+// DefaultRetryPolicy. Tests and ops can tune it per backend (S3 vs NFS vs
+// VFS) by passing a different policy instead of mutating shared global
+// state.
+//
+// cipher is optional and only needed for backups created with
+// LonghornBackupParameterEncryption=true: if the block's leading bytes carry
+// the encrypted-block magic, it's decrypted with cipher before codec
+// sniffing runs against the plaintext. Blocks without that magic are read
+// unchanged, so encryption-disabled backups restore exactly as before. Pass
+// nil when the backup isn't encrypted.
+func DecompressAndVerifyWithFallback(ctx context.Context, bsDriver BackupStoreDriver, blkFile, decompression, checksum string, policy *RetryPolicy, cipher Cipher) (io.Reader, error) {
+	p := DefaultRetryPolicy
+	if policy != nil {
+		p = *policy
+	}
+
+	rc, err := readBlockWithRetry(ctx, bsDriver, blkFile, p)
 	if err != nil {
 		return nil, err
 	}
@@ -106,36 +188,52 @@ func DecompressAndVerifyWithFallback(bsDriver BackupStoreDriver, blkFile, decomp
 		_ = rc.Close()
 	}()
 
-	r, err := util.DecompressAndVerify(decompression, rc, checksum)
-	if err == nil {
-		return r, nil
+	br := bufio.NewReader(rc)
+	header, err := br.Peek(maxMagicLen)
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrapf(err, "failed to read header of block %v", blkFile)
 	}
 
-	// If there's an error, determine the alternative decompression method
-	alternativeDecompression := ""
-	if strings.Contains(err.Error(), gzip.ErrHeader.Error()) {
-		alternativeDecompression = "lz4"
-	} else if strings.Contains(err.Error(), "lz4: bad magic number") {
-		alternativeDecompression = "gzip"
+	// Buffer the rest of the block once so a failed codec guess can be
+	// retried against the bytes we already have instead of re-reading blkFile.
+	raw, err := io.ReadAll(br)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read block %v", blkFile)
 	}
 
-	// Second attempt with alternative decompression, if applicable
-	if alternativeDecompression != "" {
-		retriedRc, err := readBlockWithRetry(bsDriver, blkFile)
-		if err != nil {
-			return nil, err
+	if isEncryptedBlock(header) {
+		if cipher == nil {
+			return nil, errors.Errorf("block %v is encrypted but no cipher was provided", blkFile)
 		}
-		defer func() {
-			_ = retriedRc.Close()
-		}()
-
-		r, err = util.DecompressAndVerify(alternativeDecompression, retriedRc, checksum)
+		raw, err = openBlock(cipher, raw)
 		if err != nil {
-			return nil, errors.Wrapf(err, "fallback decompression also failed for block %v", blkFile)
+			return nil, errors.Wrapf(err, "failed to decrypt block %v", blkFile)
 		}
+		if len(raw) > maxMagicLen {
+			header = raw[:maxMagicLen]
+		} else {
+			header = raw
+		}
+	}
+
+	// Only fall back to the caller-supplied decompression parameter when no
+	// magic matches, e.g. raw/uncompressed blocks.
+	name := decompression
+	if codec := sniffCodec(header); codec != nil {
+		name = codec.Name()
+	}
+
+	r, err := decompressAndVerify(name, raw, checksum)
+	if err == nil {
 		return r, nil
 	}
 
+	for _, alt := range candidateCodecs(header, name) {
+		if r, altErr := decompressAndVerify(alt.Name(), raw, checksum); altErr == nil {
+			return r, nil
+		}
+	}
+
 	return nil, errors.Wrapf(err, "decompression verification failed for block %v", blkFile)
 }
 
@@ -0,0 +1,57 @@
+package backupstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIsTransient(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"not found", errors.New("object not found"), false},
+		{"no such key", errors.New("NoSuchKey: no such key"), false},
+		{"404", errors.New("404 Not Found"), false},
+		{"5xx", errors.New("500 Internal Server Error"), true},
+		{"connection reset", errors.New("read: connection reset by peer"), true},
+		{"eof", errors.New("unexpected EOF"), true},
+		{"throttled", errors.New("request throttled, slow down"), true},
+		{"unrecognized defaults transient", errors.New("some unmapped backend error"), true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isTransient(c.err); got != c.want {
+				t.Errorf("isTransient(%v) = %v, want %v", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+func TestBackoffCap(t *testing.T) {
+	policy := RetryPolicy{
+		BaseDelay: 500 * time.Millisecond,
+		Factor:    2.0,
+		MaxDelay:  5 * time.Minute,
+	}
+
+	cases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, 500 * time.Millisecond},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{20, 5 * time.Minute}, // capped
+	}
+
+	for _, c := range cases {
+		if got := backoffCap(policy, c.attempt); got != c.want {
+			t.Errorf("backoffCap(attempt=%d) = %v, want %v", c.attempt, got, c.want)
+		}
+	}
+}